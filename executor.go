@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ExecConfig describes how a build command should be run: which container
+// image to run it in (if any), what else to bind into that container, and
+// what environment to expose to it. It's assembled from .goci.yml / git
+// config and handed to an Executor.
+type ExecConfig struct {
+	Image   string
+	Volumes []string
+	Env     []string
+}
+
+// Executor runs a command on behalf of a build. LocalExec runs it directly
+// on the host; DockerExec and PodmanExec run it inside cfg.Image, so builds
+// don't depend on whatever cross-compilers happen to be installed locally.
+type Executor interface {
+	Run(cfg ExecConfig, dir string, out io.Writer, name string, arg ...string) error
+}
+
+// LocalExec runs commands directly on the host, exactly as goci always has.
+type LocalExec struct{}
+
+func (LocalExec) Run(cfg ExecConfig, dir string, out io.Writer, name string, arg ...string) error {
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// containerExec runs name/arg inside cfg.Image using bin (docker or podman),
+// mounting dir at /workspace as the working directory.
+func containerExec(bin string, cfg ExecConfig, dir string, out io.Writer, name string, arg ...string) error {
+	args := []string{"run", "--rm", "-w", "/workspace", "-v", dir + ":/workspace"}
+	for _, v := range cfg.Volumes {
+		args = append(args, "-v", v)
+	}
+	for _, e := range cfg.Env {
+		args = append(args, "-e", e)
+	}
+	args = append(args, cfg.Image, name)
+	args = append(args, arg...)
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// DockerExec runs commands inside cfg.Image using docker.
+type DockerExec struct{}
+
+func (DockerExec) Run(cfg ExecConfig, dir string, out io.Writer, name string, arg ...string) error {
+	return containerExec("docker", cfg, dir, out, name, arg...)
+}
+
+// PodmanExec runs commands inside cfg.Image using podman.
+type PodmanExec struct{}
+
+func (PodmanExec) Run(cfg ExecConfig, dir string, out io.Writer, name string, arg ...string) error {
+	return containerExec("podman", cfg, dir, out, name, arg...)
+}
+
+// ExecutorFor picks the Executor appropriate for cfg and the project's
+// goci.executor setting. Projects with no image configured build on the
+// host, same as before containers were supported.
+func ExecutorFor(cfg ExecConfig, executorName string) Executor {
+	if cfg.Image == "" {
+		return LocalExec{}
+	}
+	switch executorName {
+	case "podman":
+		return PodmanExec{}
+	default:
+		return DockerExec{}
+	}
+}
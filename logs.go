@@ -0,0 +1,97 @@
+package main
+
+import "sync"
+
+// logBufCap bounds how much scrollback a buildLog keeps for clients that
+// connect to the logs action after a build has already produced output.
+const logBufCap = 1 << 20 // 1MiB
+
+// buildLog is an append-only ring buffer of a build's combined stdout and
+// stderr, with a broadcast condition so that Logs handlers can replay
+// history and then block for new writes instead of polling Status.
+type buildLog struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	total  int // bytes ever written, so a follower's position survives a trim
+	closed bool
+}
+
+func newBuildLog() *buildLog {
+	l := &buildLog{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+	l.total += len(p)
+	if excess := len(l.buf) - logBufCap; excess > 0 {
+		l.buf = l.buf[excess:]
+	}
+	l.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close marks the build as finished, waking any followers so they can stop
+// waiting for output that will never come.
+func (l *buildLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// Follow calls emit with whatever of the buffer hasn't been sent yet, then
+// blocks for more until the build closes its log or stop fires. It returns
+// once the build is finished, emit asks to stop, or stop fires.
+//
+// pos tracks an absolute offset into the stream (relative to l.total), not
+// an index into l.buf directly, since Write trims l.buf from the front once
+// it exceeds logBufCap and an index into the old slice would no longer line
+// up with the new one.
+func (l *buildLog) Follow(stop <-chan struct{}, emit func([]byte) bool) {
+	go func() {
+		<-stop
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pos := l.total - len(l.buf)
+	for {
+		bufStart := l.total - len(l.buf)
+		if pos < bufStart {
+			// Write trimmed past where we'd got to; the bytes in between
+			// are gone, so skip ahead instead of misreading l.buf.
+			pos = bufStart
+		}
+		if pos < l.total {
+			chunk := l.buf[pos-bufStart:]
+			pos = l.total
+			l.mu.Unlock()
+			ok := emit(chunk)
+			l.mu.Lock()
+			if !ok {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if l.closed {
+			return
+		}
+		l.cond.Wait()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestBuildLogFollowSurvivesTrim exercises Write trimming the ring buffer
+// out from under an in-progress Follow: a follower's position must stay
+// aligned with the buffer after data is dropped from the front, instead of
+// replaying stale or misaligned bytes.
+func TestBuildLogFollowSurvivesTrim(t *testing.T) {
+	l := newBuildLog()
+	l.Write([]byte("start"))
+
+	proceed := make(chan struct{})
+	done := make(chan []byte)
+	go func() {
+		var got []byte
+		first := true
+		l.Follow(nil, func(chunk []byte) bool {
+			got = append(got, chunk...)
+			if first {
+				first = false
+				close(proceed)
+			}
+			return true
+		})
+		done <- got
+	}()
+
+	<-proceed // follower has replayed "start" before we trim past it
+
+	l.Write(bytes.Repeat([]byte{'x'}, logBufCap)) // forces a trim past "start"
+	l.Write([]byte("TAIL"))
+	l.Close()
+
+	got := <-done
+	if !strings.HasSuffix(string(got), "TAIL") {
+		end := len(got) - 8
+		if end < 0 {
+			end = 0
+		}
+		t.Fatalf("Follow output does not end with the last write after a trim: %q", got[end:])
+	}
+}
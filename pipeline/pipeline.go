@@ -0,0 +1,114 @@
+// Package pipeline parses .goci.yml, goci's in-repo pipeline format: a list
+// of named steps with a per-step image, shell commands, environment,
+// when: conditions on the ref being built, and a matrix: axis that expands
+// a step into one instance per combination of axis values.
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Pipeline struct {
+	Steps []Step `yaml:"steps"`
+}
+
+type Step struct {
+	Name     string              `yaml:"name"`
+	Image    string              `yaml:"image"`
+	Volumes  []string            `yaml:"volumes"`
+	Commands []string            `yaml:"commands"`
+	Env      map[string]string   `yaml:"env"`
+	When     When                `yaml:"when"`
+	Matrix   map[string][]string `yaml:"matrix"`
+}
+
+type When struct {
+	Branch []string `yaml:"branch"`
+	Tag    []string `yaml:"tag"`
+}
+
+// Parse reads a .goci.yml document.
+func Parse(data []byte) (*Pipeline, error) {
+	var p Pipeline
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("pipeline: %w", err)
+	}
+	return &p, nil
+}
+
+// Matches reports whether the step should run for a ref, given whether that
+// ref is a tag (as opposed to a branch). A step with no when: always runs.
+func (w When) Matches(ref string, isTag bool) bool {
+	patterns := w.Branch
+	if isTag {
+		patterns = w.Tag
+	}
+	if len(patterns) == 0 {
+		return len(w.Branch) == 0 && len(w.Tag) == 0 || isTag == (len(w.Tag) > 0)
+	}
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand expands s.Matrix into one Step per combination of axis values, with
+// each combination's values merged into that Step's Env (and Matrix
+// cleared, since it's already been applied). A Step with no Matrix expands
+// to itself.
+func (s Step) Expand() []Step {
+	if len(s.Matrix) == 0 {
+		return []Step{s}
+	}
+
+	axes := make([]string, 0, len(s.Matrix))
+	for axis := range s.Matrix {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes) // deterministic expansion order
+
+	steps := []Step{{}}
+	for _, axis := range axes {
+		var expanded []Step
+		for _, step := range steps {
+			for _, value := range s.Matrix[axis] {
+				env := make(map[string]string, len(step.Env)+1)
+				for k, v := range step.Env {
+					env[k] = v
+				}
+				env[axis] = value
+				expanded = append(expanded, Step{Env: env})
+			}
+		}
+		steps = expanded
+	}
+
+	out := make([]Step, len(steps))
+	for i, combo := range steps {
+		step := s
+		step.Matrix = nil
+		step.Env = make(map[string]string, len(s.Env)+len(combo.Env))
+		for k, v := range s.Env {
+			step.Env[k] = v
+		}
+		for k, v := range combo.Env {
+			step.Env[k] = v
+		}
+
+		pairs := make([]string, len(axes))
+		for j, axis := range axes {
+			pairs[j] = axis + "=" + combo.Env[axis]
+		}
+		step.Name = fmt.Sprintf("%s (%s)", s.Name, strings.Join(pairs, ", "))
+
+		out[i] = step
+	}
+	return out
+}
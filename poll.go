@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// pollLoop mirrors proj's upstream by fetching on an interval and enqueuing
+// a build for any tracked branch whose tip has moved since the last fetch.
+// It's goci's fallback for forges that can't reach this server to deliver a
+// webhook. Disabled by default; enabled per-project via goci.poll.interval.
+func (proj *Project) pollLoop(sched *Scheduler) {
+	interval, _ := proj.exec("git", "config", "goci.poll.interval")
+	if interval == "" {
+		return
+	}
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		log.Printf("%s: invalid goci.poll.interval %q: %v", proj.Name, interval, err)
+		return
+	}
+
+	seen := map[string]string{}
+	for range time.Tick(d) {
+		if err := proj.Fetch(); err != nil {
+			log.Print(err)
+			continue
+		}
+
+		branches, err := proj.execLines("git", "for-each-ref", "--format=%(refname:short)", "refs/heads")
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		allowed, _ := proj.execLines("git", "config", "--get-all", "goci.poll.branches")
+		for _, branch := range branches {
+			if len(allowed) > 0 && !branchAllowed(branch, allowed) {
+				continue
+			}
+
+			tip, err := proj.exec("git", "rev-parse", "--short", "refs/heads/"+branch)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			if old, ok := seen[branch]; ok && old != tip {
+				build, err := proj.GetBuild(tip)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				build.StartBuild(sched, branch, false)
+			}
+			seen[branch] = tip
+		}
+	}
+}
@@ -4,6 +4,8 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -11,6 +13,10 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"goci/pipeline"
+	"goci/store"
 )
 
 type Project struct {
@@ -19,6 +25,7 @@ type Project struct {
 	path   string
 	build  map[string]*Build
 	buildM sync.Mutex
+	store  store.Store
 }
 
 func OpenProject(name, path string) (proj *Project, err error) {
@@ -64,6 +71,16 @@ func (proj *Project) exec(name string, arg ...string) (string, error) {
 	return strings.TrimRight(string(out), "\n"), nil
 }
 
+// execLines is like exec, but splits the output on newlines, for
+// multi-valued git config entries such as goci.volume.
+func (proj *Project) execLines(name string, arg ...string) ([]string, error) {
+	out, err := proj.exec(name, arg...)
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return strings.Split(out, "\n"), nil
+}
+
 func (proj *Project) Fetch() error {
 	_, err := proj.exec("git", "fetch")
 	return err
@@ -84,6 +101,14 @@ func (proj *Project) Ref(ref string) (actualRef string, hash bool, err error) {
 	return actualRef, hash, nil
 }
 
+// IsTag reports whether ref names a tag in proj, as opposed to a branch or
+// bare commit. Used to classify a pushed or browsed ref before queuing a
+// build, so .goci.yml when: conditions can tell branches and tags apart.
+func (proj *Project) IsTag(ref string) bool {
+	_, err := proj.exec("git", "rev-parse", "--verify", "--quiet", "refs/tags/"+ref)
+	return err == nil
+}
+
 type Build struct {
 	Proj *Project
 	Ref  string
@@ -92,8 +117,36 @@ type Build struct {
 
 	CodePath, FilesPath string
 
-	status   int32
-	buildLog string
+	branch    string
+	tag       bool
+	startedAt time.Time
+
+	status     int32
+	steps      []StepResult
+	logs       *buildLog
+	cancelCh   chan struct{}
+	cancelOnce sync.Once
+}
+
+// Cancel requests that build stop: if it's still queued, it's marked
+// cancelled immediately; if it's already running, it stops at the next
+// step boundary. Used by the Scheduler to supersede an older build for a
+// branch when a newer one is queued for the same branch.
+func (build *Build) Cancel() {
+	build.cancelOnce.Do(func() {
+		close(build.cancelCh)
+		if atomic.CompareAndSwapInt32(&build.status, int32(BuildQueued), int32(BuildCancelled)) {
+			build.logs.Close()
+		}
+	})
+}
+
+// StepResult is the outcome of a single pipeline step (or, for projects with
+// no .goci.yml, a single build target).
+type StepResult struct {
+	Name   string      `json:"name"`
+	Status BuildStatus `json:"status"`
+	Log    string      `json:"log"`
 }
 
 func (proj *Project) GetBuild(ref string) (*Build, error) {
@@ -115,59 +168,108 @@ func (proj *Project) GetBuild(ref string) (*Build, error) {
 			Proj: proj, Ref: ref, Desc: desc, path: path,
 			CodePath:  filepath.Join(path, "code"),
 			FilesPath: filepath.Join(path, "files"),
+			logs:      newBuildLog(),
+			cancelCh:  make(chan struct{}),
 		}
 		proj.build[ref] = build
 	}
 	return build, nil
 }
 
-func (build *Build) StartBuild() {
-	if !atomic.CompareAndSwapInt32(&build.status, int32(BuildNotStarted), int32(BuildInProgress)) {
+// StartBuild queues build on sched. If branch is non-empty, it names the
+// branch this build belongs to, so that a later build for the same branch
+// can supersede this one. isTag reports whether the ref being built is a
+// tag rather than a branch, for matching .goci.yml when: conditions.
+func (build *Build) StartBuild(sched *Scheduler, branch string, isTag bool) {
+	if !atomic.CompareAndSwapInt32(&build.status, int32(BuildNotStarted), int32(BuildQueued)) {
 		return
 	}
+	build.branch = branch
+	build.tag = isTag
 
-	go func() {
-		var err error
-		status := BuildFailed
+	branchKey := ""
+	if branch != "" {
+		branchKey = build.Proj.Name + "/" + branch
+	}
+	sched.Enqueue(build, branchKey)
+}
 
-		defer func() {
-			if err != nil {
-				build.buildLog = err.Error()
-				status = BuildFailed
-			}
-			if status == BuildFailed {
-				os.RemoveAll(build.FilesPath)
-			}
-			atomic.StoreInt32(&build.status, int32(status))
-		}()
-
-		codeErr := os.Mkdir(build.CodePath, 0777)
-		filesErr := os.Mkdir(build.FilesPath, 0777)
-		if os.IsExist(codeErr) {
-			if os.IsExist(filesErr) {
-				status = BuildFinished
-			} else {
-				status = BuildFailed
-			}
-			return
-		} else if codeErr != nil {
-			err = codeErr
-			return
-		} else if filesErr != nil {
-			err = filesErr
-			return
-		}
+// run actually performs the build. It's called by the Scheduler once a
+// worker is free.
+func (build *Build) run() {
+	if !atomic.CompareAndSwapInt32(&build.status, int32(BuildQueued), int32(BuildInProgress)) {
+		return // cancelled before a worker picked it up
+	}
+
+	build.startedAt = time.Now()
 
-		_, err = build.Proj.exec("git", "--work-tree", build.CodePath, "checkout", "--detach", build.Ref)
+	var err error
+	status := BuildFailed
+
+	defer func() {
 		if err != nil {
-			return
+			build.steps = append(build.steps, StepResult{Name: "goci", Status: BuildFailed, Log: err.Error()})
+			status = BuildFailed
+		}
+		if status == BuildFailed || status == BuildCancelled {
+			os.RemoveAll(build.FilesPath)
 		}
-		_, err = build.Proj.exec("git", "--work-tree", build.CodePath, "reset", "--hard")
+		atomic.StoreInt32(&build.status, int32(status))
+		build.logs.Close()
+		build.saveRecord(status)
+	}()
+
+	select {
+	case <-build.cancelCh:
+		status = BuildCancelled
+		return
+	default:
+	}
+
+	codeErr := os.Mkdir(build.CodePath, 0777)
+	filesErr := os.Mkdir(build.FilesPath, 0777)
+	if os.IsExist(codeErr) {
+		if os.IsExist(filesErr) {
+			status = BuildFinished
+		} else {
+			status = BuildFailed
+		}
+		return
+	} else if codeErr != nil {
+		err = codeErr
+		return
+	} else if filesErr != nil {
+		err = filesErr
+		return
+	}
+
+	_, err = build.Proj.exec("git", "--work-tree", build.CodePath, "checkout", "--detach", build.Ref)
+	if err != nil {
+		return
+	}
+	_, err = build.Proj.exec("git", "--work-tree", build.CodePath, "reset", "--hard")
+	if err != nil {
+		return
+	}
+
+	image, _ := build.Proj.exec("git", "--work-tree", build.CodePath, "config", "goci.image")
+	volumes, _ := build.Proj.execLines("git", "--work-tree", build.CodePath, "config", "--get-all", "goci.volume")
+	env, _ := build.Proj.execLines("git", "--work-tree", build.CodePath, "config", "--get-all", "goci.env")
+	execCfg := ExecConfig{Image: image, Volumes: volumes, Env: env}
+
+	pipelineData, pipelineErr := os.ReadFile(filepath.Join(build.CodePath, ".goci.yml"))
+	switch {
+	case pipelineErr == nil:
+		var p *pipeline.Pipeline
+		p, err = pipeline.Parse(pipelineData)
 		if err != nil {
 			return
 		}
+		status = build.runPipeline(p, execCfg)
 
-		targetStr, err := build.Proj.exec("git", "--work-tree", build.CodePath, "config", "goci.targets")
+	case os.IsNotExist(pipelineErr):
+		var targetStr string
+		targetStr, err = build.Proj.exec("git", "--work-tree", build.CodePath, "config", "goci.targets")
 		if err != nil {
 			return
 		}
@@ -200,38 +302,56 @@ func (build *Build) StartBuild() {
 			}
 		}
 
-		buildLog := bytes.Buffer{}
-	build:
-		for _, target := range targets {
-			outfn := build.Proj.Name
-			if target.OS != "" {
-				outfn += "-" + target.OS
-			}
-			if target.Arch != "" {
-				outfn += "-" + target.Arch
-			}
-			if len(target.Tags) > 0 {
-				outfn += "-" + strings.Join(target.Tags, "-")
-			}
-			if target.OS == "windows" {
-				outfn += ".exe"
-			}
+		status = build.runTargets(targets, execCfg)
 
-			cmd := exec.Command("go", "build", "-o", filepath.Join(build.FilesPath, outfn), "-tags", strings.Join(target.Tags, ","))
-			cmd.Dir = build.CodePath
-			cmd.Env = os.Environ()
-			cmd.Stdout = &buildLog
-			cmd.Stderr = &buildLog
+	default:
+		err = pipelineErr
+	}
+}
 
-			if target.OS != "" {
-				cmd.Env = append(cmd.Env, "GOOS="+target.OS)
-			}
-			if target.Arch != "" {
-				cmd.Env = append(cmd.Env, "GOARCH="+target.Arch)
-			}
-			if target.UseCgo {
-				cmd.Env = append(cmd.Env, "CGO_ENABLED=1")
+// runTargets builds each of targets with `go build`, the way goci has
+// always built projects with no .goci.yml, recording one StepResult per
+// target and stopping at the first failure.
+func (build *Build) runTargets(targets []Target, execCfg ExecConfig) BuildStatus {
+	executorName, _ := build.Proj.exec("git", "--work-tree", build.CodePath, "config", "goci.executor")
+	executor := ExecutorFor(execCfg, executorName)
+
+	status := BuildFinished
+	for _, target := range targets {
+		select {
+		case <-build.cancelCh:
+			return BuildCancelled
+		default:
+		}
+
+		outfn := build.Proj.Name
+		if target.OS != "" {
+			outfn += "-" + target.OS
+		}
+		if target.Arch != "" {
+			outfn += "-" + target.Arch
+		}
+		if len(target.Tags) > 0 {
+			outfn += "-" + strings.Join(target.Tags, "-")
+		}
+		if target.OS == "windows" {
+			outfn += ".exe"
+		}
+
+		targetCfg := execCfg
+		var cgoErr error
+		if target.OS != "" {
+			targetCfg.Env = append(targetCfg.Env, "GOOS="+target.OS)
+		}
+		if target.Arch != "" {
+			targetCfg.Env = append(targetCfg.Env, "GOARCH="+target.Arch)
+		}
+		if target.UseCgo {
+			targetCfg.Env = append(targetCfg.Env, "CGO_ENABLED=1")
 
+			// Containers pin their own cross-gcc via the image, so only
+			// the host executor needs to guess at a -gcc prefix.
+			if _, local := executor.(LocalExec); local {
 				arch := ""
 				switch target.Arch {
 				case "":
@@ -241,7 +361,7 @@ func (build *Build) StartBuild() {
 					arch = "x86"
 				// TODO: more
 				default:
-					err = fmt.Errorf("Unknown architecture %q", target.Arch)
+					cgoErr = fmt.Errorf("Unknown architecture %q", target.Arch)
 				}
 
 				os := ""
@@ -254,37 +374,119 @@ func (build *Build) StartBuild() {
 					os = "w64-mingw32"
 				// TODO: more
 				default:
-					err = fmt.Errorf("Unknown OS %q", target.OS)
+					cgoErr = fmt.Errorf("Unknown OS %q", target.OS)
 				}
 
 				if arch != "" && os != "" {
-					cmd.Env = append(cmd.Env, fmt.Sprintf("CC=%s-%s-gcc", arch, os))
+					targetCfg.Env = append(targetCfg.Env, fmt.Sprintf("CC=%s-%s-gcc", arch, os))
 				}
-			} else {
-				cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
 			}
+		} else {
+			targetCfg.Env = append(targetCfg.Env, "CGO_ENABLED=0")
+		}
+
+		buildArgs := []string{"build", "-o", filepath.Join(build.FilesPath, outfn), "-tags", strings.Join(target.Tags, ",")}
+
+		stepLog := bytes.Buffer{}
+		out := io.MultiWriter(&stepLog, build.logs)
+		fmt.Fprintln(out, strings.Join(append([]string{"go"}, buildArgs...), " "))
+
+		var runErr error
+		if cgoErr != nil {
+			runErr = cgoErr
+		} else {
+			runErr = executor.Run(targetCfg, build.CodePath, out, "go", buildArgs...)
+		}
+		stepStatus := BuildFinished
+		switch e := runErr.(type) {
+		case nil:
+		case *exec.ExitError:
+			fmt.Fprintln(out)
+			fmt.Fprint(out, e.Error())
+			stepStatus = BuildFailed
+		default:
+			fmt.Fprint(out, runErr.Error())
+			stepStatus = BuildFailed
+		}
+
+		build.steps = append(build.steps, StepResult{Name: outfn, Status: stepStatus, Log: stepLog.String()})
+		if stepStatus == BuildFailed {
+			return BuildFailed
+		}
+		status = stepStatus
+	}
+	return status
+}
+
+// runPipeline runs each step of p sequentially, skipping steps whose when:
+// doesn't match build.branch/build.tag, and expanding each remaining step's
+// matrix: into one sub-step per combination. It records one StepResult per
+// sub-step and stops at the first failure.
+func (build *Build) runPipeline(p *pipeline.Pipeline, execCfg ExecConfig) BuildStatus {
+	executorName, _ := build.Proj.exec("git", "--work-tree", build.CodePath, "config", "goci.executor")
+
+	status := BuildFinished
+	for _, step := range p.Steps {
+		select {
+		case <-build.cancelCh:
+			return BuildCancelled
+		default:
+		}
+
+		if !step.When.Matches(build.branch, build.tag) {
+			continue
+		}
 
-			buildLog.WriteString(cmd.String())
-			buildLog.WriteByte('\n')
-
-			err := cmd.Run()
-			switch e := err.(type) {
-			case nil:
-				status = BuildFinished
-			case *exec.ExitError:
-				buildLog.WriteByte('\n')
-				buildLog.WriteString(e.Error())
-				status = BuildFailed
-				err = nil
-				break build
+		for _, sub := range step.Expand() {
+			select {
+			case <-build.cancelCh:
+				return BuildCancelled
 			default:
-				status = BuildFailed
-				break build
 			}
-		}
 
-		build.buildLog = buildLog.String()
-	}()
+			stepCfg := execCfg
+			if sub.Image != "" {
+				stepCfg.Image = sub.Image
+			}
+			if len(sub.Volumes) > 0 {
+				stepCfg.Volumes = append(stepCfg.Volumes, sub.Volumes...)
+			}
+			for k, v := range sub.Env {
+				stepCfg.Env = append(stepCfg.Env, k+"="+v)
+			}
+
+			executor := ExecutorFor(stepCfg, executorName)
+
+			stepLog := bytes.Buffer{}
+			out := io.MultiWriter(&stepLog, build.logs)
+			stepStatus := BuildFinished
+			for _, command := range sub.Commands {
+				fmt.Fprintln(out, command)
+
+				runErr := executor.Run(stepCfg, build.CodePath, out, "sh", "-c", command)
+				switch e := runErr.(type) {
+				case nil:
+				case *exec.ExitError:
+					fmt.Fprintln(out)
+					fmt.Fprint(out, e.Error())
+					stepStatus = BuildFailed
+				default:
+					fmt.Fprint(out, runErr.Error())
+					stepStatus = BuildFailed
+				}
+				if stepStatus == BuildFailed {
+					break
+				}
+			}
+
+			build.steps = append(build.steps, StepResult{Name: sub.Name, Status: stepStatus, Log: stepLog.String()})
+			if stepStatus == BuildFailed {
+				return BuildFailed
+			}
+			status = stepStatus
+		}
+	}
+	return status
 }
 
 var targetRe = regexp.MustCompile(`(\w+):(\w+)(?:\((\w+(?:,\w+)*)\))?`)
@@ -299,12 +501,40 @@ func (build *Build) Status() BuildStatus {
 	return BuildStatus(atomic.LoadInt32(&build.status))
 }
 
-func (build *Build) Log() string {
+func (build *Build) Steps() []StepResult {
 	switch build.Status() {
-	case BuildFinished, BuildFailed:
-		return build.buildLog
+	case BuildFinished, BuildFailed, BuildCancelled:
+		return build.steps
 	default:
-		return ""
+		return nil
+	}
+}
+
+// saveRecord persists build to its project's store, if one is configured.
+// Failures are logged rather than propagated, the same way goci treats
+// other best-effort housekeeping around a finished build.
+func (build *Build) saveRecord(status BuildStatus) {
+	if build.Proj.store == nil {
+		return
+	}
+
+	steps := make([]store.Step, len(build.steps))
+	for i, s := range build.steps {
+		steps[i] = store.Step{Name: s.Name, Status: s.Status.String(), Log: s.Log}
+	}
+
+	err := build.Proj.store.Put(store.Record{
+		Project:   build.Proj.Name,
+		Branch:    build.branch,
+		Ref:       build.Ref,
+		Commit:    build.Ref,
+		Status:    status.String(),
+		Steps:     steps,
+		StartedAt: build.startedAt,
+		FilesPath: build.FilesPath,
+	})
+	if err != nil {
+		log.Print(err)
 	}
 }
 
@@ -315,7 +545,7 @@ func (build *Build) Summary() BuildSummary {
 		build.Ref,
 		build.Desc,
 		build.Status(),
-		build.Log(),
+		build.Steps(),
 	}
 }
 
@@ -323,9 +553,11 @@ type BuildStatus int32
 
 const (
 	BuildNotStarted BuildStatus = iota // Not started
+	BuildQueued                        // Queued
 	BuildInProgress                    // In progress
 	BuildFinished                      // Finished
 	BuildFailed                        // Failed
+	BuildCancelled                     // Cancelled
 )
 
 func (status BuildStatus) MarshalText() ([]byte, error) {
@@ -333,10 +565,10 @@ func (status BuildStatus) MarshalText() ([]byte, error) {
 }
 
 type BuildSummary struct {
-	ProjName string      `json:"projectName"`
-	ProjURL  string      `json:"projectURL"`
-	CommitID string      `json:"commit"`
-	Summary  string      `json:"commitSummary"`
-	Status   BuildStatus `json:"status"`
-	Log      string      `json:"buildLog,omitempty"`
+	ProjName string       `json:"projectName"`
+	ProjURL  string       `json:"projectURL"`
+	CommitID string       `json:"commit"`
+	Summary  string       `json:"commitSummary"`
+	Status   BuildStatus  `json:"status"`
+	Steps    []StepResult `json:"steps,omitempty"`
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"goci/store"
+)
+
+// runRetention periodically prunes st down to policy, removing each pruned
+// build's FilesPath along with its record. It runs until the process exits,
+// so callers should invoke it in its own goroutine.
+func runRetention(st store.Store, policy store.RetentionPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		pruned, err := st.Prune(policy)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		for _, r := range pruned {
+			if r.FilesPath != "" {
+				if err := os.RemoveAll(r.FilesPath); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Scheduler runs queued builds with a bounded number of concurrent workers,
+// à la a Drone/Woodpecker agent pool, so that a burst of webhooks can't fork
+// a `go build` per ref onto the host without limit. It also supersedes
+// builds: queuing a new build for a branch cancels whichever older build
+// for that same branch hadn't finished yet.
+type Scheduler struct {
+	sem chan struct{}
+
+	mu      sync.Mutex
+	queue   []*Build
+	latest  map[string]*Build    // branch key ("project/branch") -> newest build for it
+	projSem map[string]chan bool // project name -> per-project concurrency limiter
+}
+
+func NewScheduler(maxProcs int) *Scheduler {
+	return &Scheduler{
+		sem:     make(chan struct{}, maxProcs),
+		latest:  make(map[string]*Build),
+		projSem: make(map[string]chan bool),
+	}
+}
+
+// projectSem returns proj's concurrency limiter, sized from its
+// goci.concurrency git config (default: the scheduler's global max), and
+// creates it on first use.
+func (s *Scheduler) projectSem(proj *Project) chan bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sem, ok := s.projSem[proj.Name]
+	if ok {
+		return sem
+	}
+
+	n, _ := strconv.Atoi(projectConfig(proj, "goci.concurrency"))
+	if n <= 0 {
+		n = cap(s.sem)
+	}
+	sem = make(chan bool, n)
+	s.projSem[proj.Name] = sem
+	return sem
+}
+
+func projectConfig(proj *Project, key string) string {
+	v, _ := proj.exec("git", "config", key)
+	return v
+}
+
+// Enqueue queues build to run as soon as a worker is free. If branchKey is
+// non-empty and an older build is still queued or in progress for it, that
+// build is cancelled so it doesn't race the new one.
+func (s *Scheduler) Enqueue(build *Build, branchKey string) {
+	s.mu.Lock()
+	if branchKey != "" {
+		if old := s.latest[branchKey]; old != nil && old != build {
+			old.Cancel()
+		}
+		s.latest[branchKey] = build
+	}
+	s.queue = append(s.queue, build)
+	s.mu.Unlock()
+
+	go s.run(build)
+}
+
+func (s *Scheduler) run(build *Build) {
+	projSem := s.projectSem(build.Proj)
+	projSem <- true
+	defer func() { <-projSem }()
+
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+
+	s.mu.Lock()
+	for i, b := range s.queue {
+		if b == build {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	build.run()
+}
+
+// SchedulerStatus reports the scheduler's current worker and queue state,
+// for the /-/status admin endpoint.
+type SchedulerStatus struct {
+	MaxProcs int `json:"maxProcs"`
+	Running  int `json:"running"`
+	Queued   int `json:"queued"`
+}
+
+func (s *Scheduler) Status() SchedulerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SchedulerStatus{
+		MaxProcs: cap(s.sem),
+		Running:  len(s.sem),
+		Queued:   len(s.queue),
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"mime"
@@ -10,18 +13,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"goci/store"
+	"goci/webhook"
 )
 
 type CI struct {
 	Path  string
+	sched *Scheduler
+	store store.Store
 	proj  map[string]*Project
 	projM sync.Mutex
 }
 
-func NewCI(root string) *CI {
-	return &CI{Path: root, proj: make(map[string]*Project)}
+func NewCI(root string, maxProcs int, st store.Store) *CI {
+	return &CI{Path: root, sched: NewScheduler(maxProcs), store: st, proj: make(map[string]*Project)}
 }
 
 func splitFirst(route string) (first, rest string) {
@@ -36,10 +46,16 @@ func splitFirst(route string) (first, rest string) {
 var actions = map[string]func(ci *CI, build *Build, route string, w http.ResponseWriter, r *http.Request){
 	"":      (*CI).Status,
 	"files": (*CI).Files,
+	"logs":  (*CI).Logs,
 }
 
 func (ci *CI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	project, rest := splitFirst(r.URL.Path)
+	if project == "-" {
+		ci.ServeAdmin(rest, w, r)
+		return
+	}
+
 	ref, rest := splitFirst(rest)
 	action, rest := splitFirst(rest)
 
@@ -64,6 +80,7 @@ func (ci *CI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if ref == "" {
 		if r.Method == "POST" {
 			ci.HandleWebhook(proj, w, r)
+			return
 		}
 
 		u := r.URL
@@ -95,42 +112,128 @@ func (ci *CI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	build.StartBuild()
+	build.StartBuild(ci.sched, ref, proj.IsTag(ref))
 	actionFunc(ci, build, rest, w, r)
 }
 
+// ServeAdmin handles the "-" project namespace, reserved for goci's own
+// admin endpoints rather than a git project.
+func (ci *CI) ServeAdmin(route string, w http.ResponseWriter, r *http.Request) {
+	action, rest := splitFirst(route)
+	switch action {
+	case "status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ci.sched.Status())
+	case "builds":
+		project, _ := splitFirst(rest)
+		ci.Builds(project, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Builds handles /-/builds/<project>, returning that project's build
+// history from ci.store as JSON, most recent first. The branch, offset and
+// limit query params narrow and paginate the results.
+func (ci *CI) Builds(project string, w http.ResponseWriter, r *http.Request) {
+	if ci.store == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if project == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+
+	records, err := ci.store.List(project, branch, offset, limit)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
 func (ci *CI) HandleWebhook(proj *Project, w http.ResponseWriter, r *http.Request) {
-	ty, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	var ref string
+	secret, _ := proj.exec("git", "config", "goci.webhook.secret")
+	providerName, _ := proj.exec("git", "config", "goci.webhook.provider")
+	provider := webhook.Detect(r.Header, providerName)
+
+	if !provider.Verify(secret, r.Header, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event webhook.Event
+	ty, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
 	switch ty {
 	case "application/json":
-		var hook struct {
-			After string
+		event, err = provider.Parse(body)
+		if err != nil {
+			return
 		}
-		json.NewDecoder(r.Body).Decode(&hook)
-		ref = hook.After
 	case "application/x-www-form-urlencoded", "multipart/form-data":
-		ref = r.FormValue("after")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err = r.ParseForm(); err != nil {
+			return
+		}
+		event = webhook.NewEvent(r.FormValue("ref"), r.FormValue("after"))
 	default:
 		return
 	}
 
-	if ref == "" || ref[0] == '-' {
+	if event.Commit == "" || event.Commit[0] == '-' {
 		return
 	}
-	ref, _, err = proj.Ref(ref)
+	if allowed, _ := proj.execLines("git", "config", "--get-all", "goci.webhook.allowbranch"); len(allowed) > 0 && !branchAllowed(event.Branch, allowed) {
+		return
+	}
+
+	commit, _, err := proj.Ref(event.Commit)
 	if err != nil {
 		return
 	}
-	build, err := proj.GetBuild(ref)
+	build, err := proj.GetBuild(commit)
 	if err != nil {
 		return
 	}
-	build.StartBuild()
+
+	name, isTag := event.Branch, event.Tag != ""
+	if isTag {
+		name = event.Tag
+	}
+	build.StartBuild(ci.sched, name, isTag)
+}
+
+// branchAllowed reports whether branch matches one of the glob patterns in
+// allowed, such as the configured values of goci.webhook.allowbranch or
+// goci.poll.branches.
+func branchAllowed(branch string, allowed []string) bool {
+	for _, pat := range allowed {
+		if ok, _ := path.Match(pat, branch); ok {
+			return true
+		}
+	}
+	return false
 }
 
 func (ci *CI) Status(build *Build, route string, w http.ResponseWriter, r *http.Request) {
@@ -142,6 +245,38 @@ func (ci *CI) Status(build *Build, route string, w http.ResponseWriter, r *http.
 	json.NewEncoder(w).Encode(build.Summary())
 }
 
+// Logs streams a build's combined stdout/stderr to the client as
+// Server-Sent Events: whatever the build has already produced, followed by
+// new output as it happens, until the build finishes.
+func (ci *CI) Logs(build *Build, route string, w http.ResponseWriter, r *http.Request) {
+	if route != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	build.logs.Follow(r.Context().Done(), func(chunk []byte) bool {
+		for _, line := range strings.Split(string(chunk), "\n") {
+			fmt.Fprintf(w, "data: %s\n", line)
+		}
+		fmt.Fprint(w, "\n")
+		flusher.Flush()
+		return true
+	})
+
+	fmt.Fprintf(w, "event: status\ndata: %s\n\n", build.Status())
+	flusher.Flush()
+}
+
 func (ci *CI) Files(build *Build, route string, w http.ResponseWriter, r *http.Request) {
 	if build.Status() != BuildFinished {
 		http.NotFound(w, r)
@@ -178,15 +313,36 @@ func (ci *CI) Project(name string) (proj *Project, err error) {
 		if err != nil {
 			return nil, err
 		}
+		proj.store = ci.store
 		ci.proj[name] = proj
+		go proj.pollLoop(ci.sched)
 	}
 	return proj, nil
 }
 
+func openStore(kind, path string) (store.Store, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "bolt":
+		return store.OpenBolt(path)
+	case "sqlite":
+		return store.OpenSQLite(path)
+	default:
+		return nil, fmt.Errorf("unknown -store %q", kind)
+	}
+}
+
 func main() {
 	addr := flag.String("addr", ":8080", "listen address")
 	dir := flag.String("dir", "./goci", "projects path")
+	maxProcs := flag.Int("max-procs", 4, "maximum number of builds to run concurrently")
 	useSyslog := flag.Bool("syslog", false, "log to syslog")
+	storeKind := flag.String("store", "none", "build history backend: bolt, sqlite, or none")
+	storePath := flag.String("store-path", "./goci.db", "path to the build history database")
+	keepBuilds := flag.Int("keep-builds", 0, "keep at most this many builds per project branch, 0 = unlimited")
+	keepDays := flag.Int("keep-days", 0, "delete build history older than this many days, 0 = unlimited")
+	maxArtifactBytes := flag.Int64("max-artifact-bytes", 0, "delete oldest builds once a project branch's artifacts exceed this many bytes, 0 = unlimited")
 	flag.Parse()
 
 	if *useSyslog {
@@ -197,6 +353,16 @@ func main() {
 		log.SetOutput(w)
 	}
 
-	ci := NewCI(*dir)
+	st, err := openStore(*storeKind, *storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if st != nil && (*keepBuilds > 0 || *keepDays > 0 || *maxArtifactBytes > 0) {
+		policy := store.RetentionPolicy{KeepBuilds: *keepBuilds, KeepDays: *keepDays, MaxArtifactBytes: *maxArtifactBytes}
+		go runRetention(st, policy, time.Hour)
+	}
+
+	ci := NewCI(*dir, *maxProcs, st)
 	log.Fatal(http.ListenAndServe(*addr, ci))
 }
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var buildsBucket = []byte("builds")
+
+// BoltStore persists build history in a single BoltDB file, keyed so that
+// a per-project scan yields builds newest-first.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(buildsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// buildKey sorts newest-first within a project by inverting the timestamp,
+// and disambiguates same-instant builds with ref.
+func buildKey(project string, startedAt time.Time, ref string) []byte {
+	var inverted [8]byte
+	binary.BigEndian.PutUint64(inverted[:], ^uint64(startedAt.UnixNano()))
+	return append(append([]byte(project+"\x00"), inverted[:]...), []byte("\x00"+ref)...)
+}
+
+func (s *BoltStore) Put(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(buildsBucket).Put(buildKey(r.Project, r.StartedAt, r.Ref), data)
+	})
+}
+
+func (s *BoltStore) List(project, branch string, offset, limit int) ([]Record, error) {
+	prefix := []byte(project + "\x00")
+	var records []Record
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(buildsBucket).Cursor()
+		skipped := 0
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if branch != "" && r.Branch != branch {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			if len(records) >= limit {
+				break
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (s *BoltStore) Prune(policy RetentionPolicy) ([]Record, error) {
+	var cutoff time.Time
+	if policy.KeepDays > 0 {
+		cutoff = time.Now().Add(-time.Duration(policy.KeepDays) * 24 * time.Hour)
+	}
+
+	var pruned []Record
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(buildsBucket)
+		counts := map[string]int{}
+		artifactBytes := map[string]int64{}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			// Keys are ordered newest-first within a project, so this is
+			// the r'th-newest build for project+branch.
+			key := r.Project + "\x00" + r.Branch
+			counts[key]++
+
+			drop := policy.KeepDays > 0 && r.StartedAt.Before(cutoff)
+			drop = drop || (policy.KeepBuilds > 0 && counts[key] > policy.KeepBuilds)
+			if !drop && policy.MaxArtifactBytes > 0 {
+				artifactBytes[key] += dirSize(r.FilesPath)
+				drop = artifactBytes[key] > policy.MaxArtifactBytes
+			}
+			if !drop {
+				continue
+			}
+
+			pruned = append(pruned, r)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS builds (
+	project    TEXT NOT NULL,
+	branch     TEXT NOT NULL,
+	ref        TEXT NOT NULL,
+	commit_id  TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	steps      TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	files_path TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS builds_project_branch ON builds (project, branch, started_at DESC);
+`
+
+// SQLiteStore persists build history in a SQLite database, via the pure-Go
+// modernc.org/sqlite driver so goci doesn't need cgo to use it.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Put(r Record) error {
+	steps, err := json.Marshal(r.Steps)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO builds (project, branch, ref, commit_id, status, steps, started_at, files_path)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Project, r.Branch, r.Ref, r.Commit, r.Status, string(steps), r.StartedAt.Unix(), r.FilesPath,
+	)
+	return err
+}
+
+func (s *SQLiteStore) List(project, branch string, offset, limit int) ([]Record, error) {
+	rows, err := s.db.Query(
+		`SELECT project, branch, ref, commit_id, status, steps, started_at, files_path
+		 FROM builds
+		 WHERE project = ? AND (? = '' OR branch = ?)
+		 ORDER BY started_at DESC
+		 LIMIT ? OFFSET ?`,
+		project, branch, branch, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var steps string
+		var startedAt int64
+		if err := rows.Scan(&r.Project, &r.Branch, &r.Ref, &r.Commit, &r.Status, &steps, &startedAt, &r.FilesPath); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(steps), &r.Steps); err != nil {
+			return nil, err
+		}
+		r.StartedAt = time.Unix(startedAt, 0)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) Prune(policy RetentionPolicy) ([]Record, error) {
+	cutoff := time.Now().Add(-time.Duration(policy.KeepDays) * 24 * time.Hour).Unix()
+
+	rows, err := s.db.Query(
+		`SELECT project, branch, ref, commit_id, status, steps, started_at, files_path,
+			ROW_NUMBER() OVER (PARTITION BY project, branch ORDER BY started_at DESC) AS rank
+		 FROM builds
+		 ORDER BY project, branch, started_at DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []Record
+	artifactBytes := map[string]int64{}
+	for rows.Next() {
+		var r Record
+		var steps string
+		var startedAt int64
+		var rank int
+		if err := rows.Scan(&r.Project, &r.Branch, &r.Ref, &r.Commit, &r.Status, &steps, &startedAt, &r.FilesPath, &rank); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(steps), &r.Steps); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.StartedAt = time.Unix(startedAt, 0)
+
+		drop := policy.KeepDays > 0 && startedAt < cutoff
+		drop = drop || (policy.KeepBuilds > 0 && rank > policy.KeepBuilds)
+		if !drop && policy.MaxArtifactBytes > 0 {
+			key := r.Project + "\x00" + r.Branch
+			artifactBytes[key] += dirSize(r.FilesPath)
+			drop = artifactBytes[key] > policy.MaxArtifactBytes
+		}
+		if drop {
+			pruned = append(pruned, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range pruned {
+		if _, err := s.db.Exec(
+			`DELETE FROM builds WHERE project = ? AND branch = ? AND started_at = ? AND ref = ?`,
+			r.Project, r.Branch, r.StartedAt.Unix(), r.Ref,
+		); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,68 @@
+// Package store persists build history so goci survives restarts with its
+// build records intact, and can list past builds instead of only ever
+// knowing about whatever's still in memory.
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record is one build's persisted summary: its project, commit, status and
+// steps, plus enough to list, filter and garbage-collect it later. It does
+// not hold BuildSummary's project URL or commit summary.
+type Record struct {
+	Project   string    `json:"project"`
+	Branch    string    `json:"branch"`
+	Ref       string    `json:"ref"`
+	Commit    string    `json:"commit"`
+	Status    string    `json:"status"`
+	Steps     []Step    `json:"steps"`
+	StartedAt time.Time `json:"startedAt"`
+	FilesPath string    `json:"filesPath"`
+}
+
+// Step mirrors a single StepResult.
+type Step struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Log    string `json:"log"`
+}
+
+// RetentionPolicy bounds how much history and how many artifacts a Store
+// keeps around.
+type RetentionPolicy struct {
+	KeepBuilds       int   // keep at most this many builds per project+branch, 0 = unlimited
+	KeepDays         int   // drop builds older than this many days, 0 = unlimited
+	MaxArtifactBytes int64 // drop oldest builds once a project+branch's FilesPath exceeds this, 0 = unlimited
+}
+
+// dirSize sums the size of path's regular files, for enforcing
+// MaxArtifactBytes. Errors (including a missing directory) are treated as
+// zero size, since a build whose files are already gone shouldn't block GC.
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Store persists build history. Implementations: BoltStore, SQLiteStore.
+type Store interface {
+	// Put appends a build record. Each call to Put, even for the same
+	// commit, adds a new row to the build's history rather than replacing
+	// one, since Store exists to keep that history around.
+	Put(r Record) error
+	// List returns up to limit records for project (and branch, if
+	// non-empty), most recent first, skipping the first offset matches.
+	List(project, branch string, offset, limit int) ([]Record, error)
+	// Prune deletes records that fall outside policy and returns them, so
+	// the caller can also remove their on-disk artifacts.
+	Prune(policy RetentionPolicy) ([]Record, error)
+	Close() error
+}
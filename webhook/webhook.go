@@ -0,0 +1,159 @@
+// Package webhook authenticates and parses push payloads from the forges
+// goci listens for: it verifies a provider's signature scheme against a
+// per-project secret, then extracts the ref and commit to build.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Event is the push goci cares about, independent of which forge sent it.
+type Event struct {
+	Ref    string // e.g. "refs/heads/main" or "refs/tags/v1"
+	Branch string // "main", or "" if Ref isn't a branch
+	Tag    string // "v1", or "" if Ref isn't a tag
+	Commit string // the commit to build
+}
+
+// NewEvent builds an Event from a raw ref and the commit it points at,
+// splitting ref into a Branch or Tag name depending on which namespace it's
+// under. Used both by parsePush and directly for providers, such as the
+// generic form-encoded fallback, that don't hand goci a JSON payload.
+func NewEvent(ref, commit string) Event {
+	e := Event{Ref: ref, Commit: commit}
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		e.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		e.Tag = strings.TrimPrefix(ref, "refs/tags/")
+	}
+	return e
+}
+
+// Provider verifies and parses one forge's webhook convention.
+type Provider interface {
+	// Name identifies the provider for goci.webhook.provider.
+	Name() string
+	// Verify reports whether body is authentic for secret, using whatever
+	// header this provider signs its payloads with.
+	Verify(secret string, header http.Header, body []byte) bool
+	// Parse extracts the pushed ref and commit from a JSON payload body.
+	Parse(body []byte) (Event, error)
+}
+
+// Detect picks a Provider from request headers that identify a specific
+// forge, falling back to the project's configured goci.webhook.provider,
+// and finally to Generic.
+func Detect(header http.Header, configured string) Provider {
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		return GitHub{}
+	case header.Get("X-Gitlab-Event") != "":
+		return GitLab{}
+	case header.Get("X-Gitea-Event") != "":
+		return Gitea{}
+	}
+
+	switch configured {
+	case "github":
+		return GitHub{}
+	case "gitlab":
+		return GitLab{}
+	case "gitea":
+		return Gitea{}
+	default:
+		return Generic{}
+	}
+}
+
+type pushPayload struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+func parsePush(body []byte) (Event, error) {
+	var p pushPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Event{}, err
+	}
+	return NewEvent(p.Ref, p.After), nil
+}
+
+// verifyHMACSHA256 checks header (with prefix stripped, e.g. "sha256=") as
+// the hex-encoded HMAC-SHA256 of body under secret.
+func verifyHMACSHA256(header, prefix, secret string, body []byte) bool {
+	sig := strings.TrimPrefix(header, prefix)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return len(sig) == len(expected) && hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// GitHub verifies the X-Hub-Signature-256 header GitHub (and GitHub-alike
+// forges) sign push payloads with.
+type GitHub struct{}
+
+func (GitHub) Name() string { return "github" }
+
+func (GitHub) Verify(secret string, header http.Header, body []byte) bool {
+	sig := header.Get("X-Hub-Signature-256")
+	if sig == "" || secret == "" {
+		return false
+	}
+	return verifyHMACSHA256(sig, "sha256=", secret, body)
+}
+
+func (GitHub) Parse(body []byte) (Event, error) { return parsePush(body) }
+
+// GitLab verifies the X-Gitlab-Token header, a plain shared secret rather
+// than a signature.
+type GitLab struct{}
+
+func (GitLab) Name() string { return "gitlab" }
+
+func (GitLab) Verify(secret string, header http.Header, body []byte) bool {
+	token := header.Get("X-Gitlab-Token")
+	if token == "" || secret == "" {
+		return false
+	}
+	return len(token) == len(secret) && hmac.Equal([]byte(token), []byte(secret))
+}
+
+func (GitLab) Parse(body []byte) (Event, error) { return parsePush(body) }
+
+// Gitea verifies the X-Gitea-Signature header, a bare (unprefixed)
+// hex-encoded HMAC-SHA256.
+type Gitea struct{}
+
+func (Gitea) Name() string { return "gitea" }
+
+func (Gitea) Verify(secret string, header http.Header, body []byte) bool {
+	sig := header.Get("X-Gitea-Signature")
+	if sig == "" || secret == "" {
+		return false
+	}
+	return verifyHMACSHA256(sig, "", secret, body)
+}
+
+func (Gitea) Parse(body []byte) (Event, error) { return parsePush(body) }
+
+// Generic is a catch-all for forges goci doesn't recognize by header,
+// following GitHub's X-Hub-Signature-256 convention.
+type Generic struct{}
+
+func (Generic) Name() string { return "generic" }
+
+func (Generic) Verify(secret string, header http.Header, body []byte) bool {
+	sig := header.Get("X-Hub-Signature-256")
+	if sig == "" || secret == "" {
+		return false
+	}
+	return verifyHMACSHA256(sig, "sha256=", secret, body)
+}
+
+func (Generic) Parse(body []byte) (Event, error) { return parsePush(body) }